@@ -0,0 +1,367 @@
+package ketherhomepage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ketherstatic_image_cache_hits_total",
+		Help: "Number of ad image fetches served from the on-disk cache.",
+	})
+	cacheMissesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ketherstatic_image_cache_misses_total",
+		Help: "Number of ad image fetches that went to the network.",
+	})
+	cacheVerificationFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ketherstatic_image_cache_verification_failures_total",
+		Help: "Number of ipfs:// fetches whose bytes didn't hash back to the requested CID.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHitsTotal, cacheMissesTotal, cacheVerificationFailuresTotal)
+}
+
+const defaultFetchTimeout = 15 * time.Second
+
+var defaultIPFSGateways = []string{
+	"https://gateway.ipfs.io/ipfs/",
+	"https://cloudflare-ipfs.com/ipfs/",
+	"https://ipfs.io/ipfs/",
+}
+
+// ImageFetcher fetches and decodes the images ads point to. Unlike the
+// original getImage, it fetches the whole batch of ads for a tick
+// concurrently through a bounded worker pool, keeps a content-addressed
+// on-disk cache so unchanged ads cost nothing on later ticks, and verifies
+// ipfs:// content against its CID before trusting it.
+type ImageFetcher struct {
+	cacheDir      string
+	cacheCapBytes int64
+	gateways      []string
+	httpClient    *http.Client
+	workers       int
+	fetchTimeout  time.Duration
+
+	cacheMu sync.Mutex
+}
+
+// NewImageFetcher builds an ImageFetcher backed by an on-disk cache at
+// cacheDir, capped at cacheCapBytes (LRU-evicted by file modification
+// time). gateways is the ordered list of IPFS gateways to try for ipfs://
+// URLs; pass nil to use the built-in defaults. workers controls how many
+// ads are fetched concurrently per call to FetchAll.
+func NewImageFetcher(cacheDir string, cacheCapBytes int64, gateways []string, workers int) (*ImageFetcher, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create image cache dir %q: %v", cacheDir, err)
+	}
+	if len(gateways) == 0 {
+		gateways = defaultIPFSGateways
+	}
+	if workers <= 0 {
+		workers = 8
+	}
+
+	return &ImageFetcher{
+		cacheDir:      cacheDir,
+		cacheCapBytes: cacheCapBytes,
+		gateways:      gateways,
+		httpClient:    &http.Client{Timeout: defaultFetchTimeout},
+		workers:       workers,
+		fetchTimeout:  defaultFetchTimeout,
+	}, nil
+}
+
+// FetchAll fetches the images for every ad concurrently, bounded by
+// f.workers, each with its own context.WithTimeout. Ads that share the same
+// URL (common for reused/placeholder creatives) are only fetched once, so
+// two goroutines never race to populate the same cache entry. Ads with no
+// image, or whose fetch/decode failed, are simply absent from the returned
+// map - callers should treat a missing entry the same as a failed fetch.
+func (f *ImageFetcher) FetchAll(ctx context.Context, ads []Ad) map[int]image.Image {
+	type job struct {
+		url     string
+		adIdxes []int
+	}
+
+	byURL := make(map[string][]int)
+	for _, ad := range ads {
+		if ad.Image != "" {
+			byURL[ad.Image] = append(byURL[ad.Image], ad.Idx)
+		}
+	}
+
+	jobs := make(chan job)
+	results := make(map[int]image.Image)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < f.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				reqCtx, cancel := context.WithTimeout(ctx, f.fetchTimeout)
+				img, err := f.fetch(reqCtx, j.url)
+				cancel()
+				if err != nil {
+					log.Printf("image fetcher: ads %v: failed to fetch %s: %v", j.adIdxes, j.url, err)
+					continue
+				}
+				mu.Lock()
+				for _, idx := range j.adIdxes {
+					results[idx] = img
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for url, adIdxes := range byURL {
+		jobs <- job{url: url, adIdxes: adIdxes}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+func (f *ImageFetcher) fetch(ctx context.Context, imageUrl string) (image.Image, error) {
+	u, err := url.Parse(imageUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return f.fetchCached(sha256Hex(imageUrl), func() ([]byte, error) {
+			return f.httpGet(ctx, imageUrl)
+		})
+	case "data":
+		// This is not a fully compliant way of parsing data:// urls, assumes
+		// they are base64 encoded. Should work for now though
+		imgData, err := base64.StdEncoding.DecodeString(strings.Split(u.Opaque, ",")[1])
+		if err != nil {
+			return nil, err
+		}
+		return decodeImage(imgData)
+	case "ipfs":
+		return f.fetchIPFS(ctx, u.Host)
+	case "bzz":
+		return f.fetchCached(sha256Hex(imageUrl), func() ([]byte, error) {
+			return f.httpGet(ctx, "http://swarm-gateways.net/bzz:/"+u.Host)
+		})
+	default:
+		return nil, fmt.Errorf("couldn't parse image URL: %s", imageUrl)
+	}
+}
+
+func (f *ImageFetcher) httpGet(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("GET %s: unexpected status %s", rawURL, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchIPFS tries each configured gateway in order, falling back to the
+// next on a 4xx/5xx/timeout, and verifies the returned bytes hash back to
+// cidStr before decoding them - a gateway that's been tampered with (or is
+// just serving something else under that path) is rejected rather than
+// silently trusted.
+func (f *ImageFetcher) fetchIPFS(ctx context.Context, cidStr string) (image.Image, error) {
+	if cached, ok := f.readCache(cidStr); ok {
+		cacheHitsTotal.Inc()
+		return decodeImage(cached)
+	}
+	cacheMissesTotal.Inc()
+
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ipfs CID %q: %v", cidStr, err)
+	}
+
+	var lastErr error
+	for _, gateway := range f.gateways {
+		data, err := f.httpGet(ctx, gateway+cidStr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if err := verifyCID(c, data); err != nil {
+			cacheVerificationFailuresTotal.Inc()
+			lastErr = fmt.Errorf("gateway %s: %v", gateway, err)
+			continue
+		}
+
+		f.writeCache(cidStr, data)
+		return decodeImage(data)
+	}
+
+	return nil, fmt.Errorf("all IPFS gateways failed for %s: %v", cidStr, lastErr)
+}
+
+// verifyCID re-hashes data with the CID's own hash function and checks it
+// against the multihash embedded in c, rejecting gateway tampering.
+func verifyCID(c cid.Cid, data []byte) error {
+	prefix := c.Prefix()
+	sum, err := multihash.Sum(data, prefix.MhType, prefix.MhLength)
+	if err != nil {
+		return fmt.Errorf("failed to hash response: %v", err)
+	}
+	if !bytes.Equal([]byte(sum), []byte(c.Hash())) {
+		return fmt.Errorf("response does not hash to requested CID")
+	}
+	return nil
+}
+
+// fetchCached wraps fetchFn with the on-disk cache keyed by key, fetching
+// over the network only on a miss.
+func (f *ImageFetcher) fetchCached(key string, fetchFn func() ([]byte, error)) (image.Image, error) {
+	if cached, ok := f.readCache(key); ok {
+		cacheHitsTotal.Inc()
+		return decodeImage(cached)
+	}
+	cacheMissesTotal.Inc()
+
+	data, err := fetchFn()
+	if err != nil {
+		return nil, err
+	}
+
+	f.writeCache(key, data)
+	return decodeImage(data)
+}
+
+func (f *ImageFetcher) cachePath(key string) string {
+	return filepath.Join(f.cacheDir, key)
+}
+
+// readCache reads a cache entry, touching its mtime on a hit so
+// evictIfOverCap's mtime-ordered sweep evicts the least-*recently-used*
+// entry rather than just the least-recently-written one.
+func (f *ImageFetcher) readCache(key string) ([]byte, bool) {
+	path := f.cachePath(key)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		log.Printf("image fetcher: failed to touch cache entry %s: %v", key, err)
+	}
+
+	return data, true
+}
+
+// writeCache writes through a temp file + rename, the same pattern
+// FilePublisher.writeFile uses, so two fetches racing on the same cache key
+// (e.g. two distinct URLs that happen to share a sha256, or a caller that
+// doesn't go through FetchAll's de-duplication) can't interleave their
+// writes and leave a truncated, undetectably-corrupt file behind.
+func (f *ImageFetcher) writeCache(key string, data []byte) {
+	tmp, err := ioutil.TempFile(f.cacheDir, "."+key+".tmp")
+	if err != nil {
+		log.Printf("image fetcher: failed to cache %s: %v", key, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		log.Printf("image fetcher: failed to cache %s: %v", key, err)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		log.Printf("image fetcher: failed to cache %s: %v", key, err)
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), f.cachePath(key)); err != nil {
+		log.Printf("image fetcher: failed to cache %s: %v", key, err)
+		return
+	}
+	f.evictIfOverCap()
+}
+
+// evictIfOverCap removes the least-recently-used cache entries (oldest mtime
+// first; readCache touches mtime on every hit) until the cache directory is
+// back under cacheCapBytes.
+func (f *ImageFetcher) evictIfOverCap() {
+	if f.cacheCapBytes <= 0 {
+		return
+	}
+
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+
+	entries, err := ioutil.ReadDir(f.cacheDir)
+	if err != nil {
+		return
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size()
+	}
+	if total <= f.cacheCapBytes {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	for _, e := range entries {
+		if total <= f.cacheCapBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(f.cacheDir, e.Name())); err != nil {
+			continue
+		}
+		total -= e.Size()
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func decodeImage(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
@@ -0,0 +1,308 @@
+package ketherhomepage
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	eventPublish    = "Publish"
+	eventSetAdOwner = "SetAdOwner"
+	eventForceNSFW  = "ForceNSFW"
+)
+
+// ChainClient is the subset of *ethclient.Client the Indexer relies on for
+// log filtering and subscriptions. It exists so tests can point an Indexer
+// at a backends.SimulatedBackend instead of a real RPC node.
+type ChainClient interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+	SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error)
+}
+
+// Indexer maintains an in-memory view of the ad grid by applying
+// KetherHomepage contract events, either from a one-off FilterLogs sweep or
+// from a live SubscribeFilterLogs subscription. It replaces the old
+// "re-fetch every ad on every tick" approach with an incremental one: RPC
+// load is proportional to the number of events, not ads * ticks.
+type Indexer struct {
+	name         string
+	rpcClient    ChainClient
+	contractAddr common.Address
+	contractABI  abi.ABI
+
+	mu        sync.Mutex
+	ads       map[int]Ad
+	lastBlock uint64
+	dirty     bool
+}
+
+// NewIndexer builds an Indexer that starts scanning from fromBlock. fromBlock
+// should be either a previously-persisted block number or the contract's
+// deployment block on first run.
+func NewIndexer(name string, rpcClient ChainClient, contractAddr common.Address, fromBlock uint64) (*Indexer, error) {
+	parsed, err := abi.JSON(strings.NewReader(KetherHomepageABI))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse KetherHomepage ABI: %v", err)
+	}
+
+	return &Indexer{
+		name:         name,
+		rpcClient:    rpcClient,
+		contractAddr: contractAddr,
+		contractABI:  parsed,
+		ads:          make(map[int]Ad),
+		lastBlock:    fromBlock,
+	}, nil
+}
+
+func (idx *Indexer) filterQuery(fromBlock uint64, toBlock *big.Int) ethereum.FilterQuery {
+	topic0 := []common.Hash{
+		idx.contractABI.Events[eventPublish].ID,
+		idx.contractABI.Events[eventSetAdOwner].ID,
+		idx.contractABI.Events[eventForceNSFW].ID,
+	}
+	return ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(fromBlock),
+		ToBlock:   toBlock,
+		Addresses: []common.Address{idx.contractAddr},
+		Topics:    [][]common.Hash{topic0},
+	}
+}
+
+// Sync performs a one-off FilterLogs sweep from the last-processed block up
+// to the current chain head, applying every matching event in order.
+func (idx *Indexer) Sync(ctx context.Context) error {
+	header, err := idx.rpcClient.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: failed to fetch head for sync: %v", idx.name, err)
+	}
+
+	logs, err := idx.rpcClient.FilterLogs(ctx, idx.filterQuery(idx.lastBlock, header.Number))
+	if err != nil {
+		return fmt.Errorf("%s: FilterLogs failed: %v", idx.name, err)
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, l := range logs {
+		idx.applyLog(l)
+	}
+	if header.Number.Uint64() > idx.lastBlock {
+		idx.lastBlock = header.Number.Uint64()
+	}
+	return nil
+}
+
+// Subscribe opens a SubscribeFilterLogs websocket subscription for new
+// blocks, then catches up on anything between the last-processed block and
+// the subscription's registration with a single Sync call, and applies
+// events to the in-memory map as they arrive. Real nodes don't honor
+// FromBlock on a live log subscription - it only streams logs from the
+// moment of registration onward - so the catch-up sweep has to happen
+// *after* the subscription is open, or events in between would be lost
+// forever: Sync advances lastBlock to the head it observes, and if that
+// happened before the subscription existed, nothing would ever re-scan the
+// gap. After each log from the subscription is applied, changed is signalled
+// with a non-blocking send, so a signal is dropped if one is already pending;
+// the catch-up Sync does not signal it. changed is never closed by
+// Subscribe. Subscribe blocks until ctx is cancelled or the subscription
+// errors out.
+func (idx *Indexer) Subscribe(ctx context.Context, changed chan<- struct{}) error {
+	logsCh := make(chan types.Log)
+	sub, err := idx.rpcClient.SubscribeFilterLogs(ctx, idx.filterQuery(idx.lastBlock+1, nil), logsCh)
+	if err != nil {
+		return fmt.Errorf("%s: SubscribeFilterLogs failed: %v", idx.name, err)
+	}
+	defer sub.Unsubscribe()
+
+	if err := idx.Sync(ctx); err != nil {
+		return fmt.Errorf("%s: catch-up sync after subscribing failed: %v", idx.name, err)
+	}
+
+	for {
+		select {
+		case err := <-sub.Err():
+			return fmt.Errorf("%s: log subscription error: %v", idx.name, err)
+		case l := <-logsCh:
+			idx.mu.Lock()
+			idx.applyLog(l)
+			if l.BlockNumber > idx.lastBlock {
+				idx.lastBlock = l.BlockNumber
+			}
+			idx.mu.Unlock()
+
+			select {
+			case changed <- struct{}{}:
+			default:
+				// a regen is already pending; no need to queue another signal
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// applyLog decodes a single log against the known event signatures and
+// mutates idx.ads accordingly. Callers must hold idx.mu.
+func (idx *Indexer) applyLog(l types.Log) {
+	if len(l.Topics) == 0 {
+		return
+	}
+
+	event, err := idx.contractABI.EventByID(l.Topics[0])
+	if err != nil {
+		// Not one of our events (shouldn't happen given the topic filter,
+		// but new event signatures in a future contract version could land
+		// here - skip rather than fail the whole sweep).
+		return
+	}
+
+	switch event.Name {
+	case eventPublish:
+		idx.applyPublish(l)
+	case eventSetAdOwner:
+		idx.applySetAdOwner(l)
+	case eventForceNSFW:
+		idx.applyForceNSFW(l)
+	default:
+		// A future contract version may emit events we don't know how to
+		// apply yet; skip rather than fail the whole sweep.
+		log.Printf("%s: skipping unknown event %s", idx.name, event.Name)
+	}
+}
+
+func (idx *Indexer) applyPublish(l types.Log) {
+	out := map[string]interface{}{}
+	if err := idx.contractABI.UnpackIntoMap(out, eventPublish, l.Data); err != nil {
+		return
+	}
+
+	i := int(topicToBigInt(l.Topics[1]).Int64())
+	ad := idx.ads[i]
+	ad.Idx = i
+	if owner, ok := out["owner"].(common.Address); ok {
+		ad.Owner = owner.Hex()
+	}
+	if x, ok := out["x"].(*big.Int); ok {
+		ad.X = int(x.Int64())
+	}
+	if y, ok := out["y"].(*big.Int); ok {
+		ad.Y = int(y.Int64())
+	}
+	if width, ok := out["width"].(*big.Int); ok {
+		ad.Width = int(width.Int64())
+	}
+	if height, ok := out["height"].(*big.Int); ok {
+		ad.Height = int(height.Int64())
+	}
+	if link, ok := out["link"].(string); ok {
+		ad.Link = link
+	}
+	if image, ok := out["image"].(string); ok {
+		ad.Image = image
+	}
+	if title, ok := out["title"].(string); ok {
+		ad.Title = title
+	}
+	if nsfw, ok := out["NSFW"].(bool); ok {
+		ad.NSFW = nsfw
+	}
+
+	idx.ads[i] = ad
+	idx.dirty = true
+}
+
+func (idx *Indexer) applySetAdOwner(l types.Log) {
+	out := map[string]interface{}{}
+	if err := idx.contractABI.UnpackIntoMap(out, eventSetAdOwner, l.Data); err != nil {
+		return
+	}
+
+	i := int(topicToBigInt(l.Topics[1]).Int64())
+	ad, ok := idx.ads[i]
+	if !ok {
+		return
+	}
+	if owner, ok := out["owner"].(common.Address); ok {
+		ad.Owner = owner.Hex()
+	}
+	idx.ads[i] = ad
+	idx.dirty = true
+}
+
+func (idx *Indexer) applyForceNSFW(l types.Log) {
+	out := map[string]interface{}{}
+	if err := idx.contractABI.UnpackIntoMap(out, eventForceNSFW, l.Data); err != nil {
+		return
+	}
+
+	i := int(topicToBigInt(l.Topics[1]).Int64())
+	ad, ok := idx.ads[i]
+	if !ok {
+		return
+	}
+	if status, ok := out["status"].(bool); ok {
+		ad.ForceNSFW = status
+	}
+	idx.ads[i] = ad
+	idx.dirty = true
+}
+
+func topicToBigInt(topic common.Hash) *big.Int {
+	return new(big.Int).SetBytes(topic.Bytes())
+}
+
+// Snapshot returns a copy of the current ad map as a dense slice (missing
+// indices are filled with Ad{Idx: i} rather than the zero Ad, so a gap
+// never gets mistaken for ad 0) along with the last-processed block number.
+// It does not clear the dirty flag - callers that go on to publish the
+// snapshot should call ClearDirty once publishing actually succeeds, so a
+// failed publish leaves the indexer dirty for the next retry.
+func (idx *Indexer) Snapshot() ([]Ad, uint64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	length := 0
+	for i := range idx.ads {
+		if i+1 > length {
+			length = i + 1
+		}
+	}
+
+	ads := make([]Ad, length)
+	for i := range ads {
+		ads[i] = Ad{Idx: i}
+	}
+	for i, ad := range idx.ads {
+		ads[i] = ad
+	}
+
+	return ads, idx.lastBlock
+}
+
+// Dirty reports whether the ad map has changed since the last ClearDirty call.
+func (idx *Indexer) Dirty() bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.dirty
+}
+
+// ClearDirty marks the indexer as having no unpublished changes. Callers
+// should only call this once a Snapshot has actually been published
+// successfully; see Snapshot.
+func (idx *Indexer) ClearDirty() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.dirty = false
+}
@@ -0,0 +1,168 @@
+package ketherhomepage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Verdict is a moderation decision for a single ad.
+type Verdict string
+
+const (
+	// VerdictAllow renders the ad normally.
+	VerdictAllow Verdict = "allow"
+	// VerdictBlur renders a downsampled, box-blurred version of the ad so
+	// front-ends can offer a "click to reveal" affordance.
+	VerdictBlur Verdict = "blur"
+	// VerdictBlock renders a solid NSFW placeholder instead of the ad.
+	VerdictBlock Verdict = "block"
+)
+
+// Moderator decides how an ad's image should be rendered, on top of (or
+// instead of) the on-chain NSFW/ForceNSFW flags.
+type Moderator interface {
+	// Classify looks at the decoded ad image and returns a verdict and a
+	// confidence score in [0, 1]; score is implementation-defined and may be
+	// 0 for Moderators that don't produce one.
+	Classify(ctx context.Context, adIdx int, img image.Image) (Verdict, float64, error)
+	// Override returns a verdict that should take precedence over Classify
+	// and the on-chain flags, and whether one is configured for adIdx at
+	// all.
+	Override(adIdx int) (Verdict, bool)
+}
+
+// PassthroughModerator never overrides and never blurs/blocks on its own
+// authority - it preserves the pre-Moderator behavior where only the
+// on-chain NSFW/ForceNSFW flags (handled by the caller) drive moderation.
+type PassthroughModerator struct{}
+
+func (PassthroughModerator) Classify(ctx context.Context, adIdx int, img image.Image) (Verdict, float64, error) {
+	return VerdictAllow, 0, nil
+}
+
+func (PassthroughModerator) Override(adIdx int) (Verdict, bool) {
+	return "", false
+}
+
+// ListModerator is a static allow/deny list keyed by ad index, loaded from a
+// YAML or JSON file (YAML is a superset of JSON, so the same loader handles
+// both). It lets operators override the on-chain flags without sending a
+// transaction. It never classifies on its own.
+type ListModerator struct {
+	mu        sync.RWMutex
+	overrides map[int]Verdict
+}
+
+// NewListModerator loads a ListModerator from a file containing a mapping
+// of ad index (as a string key) to verdict, e.g.:
+//
+//	"12": block
+//	"47": allow
+func NewListModerator(path string) (*ListModerator, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read moderation list %q: %v", path, err)
+	}
+
+	var entries map[string]string
+	if err := yaml.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse moderation list %q: %v", path, err)
+	}
+
+	overrides := make(map[int]Verdict, len(entries))
+	for key, value := range entries {
+		idx, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("moderation list %q: invalid ad index %q", path, key)
+		}
+		verdict := Verdict(value)
+		if verdict != VerdictAllow && verdict != VerdictBlur && verdict != VerdictBlock {
+			return nil, fmt.Errorf("moderation list %q: invalid verdict %q for ad %d", path, value, idx)
+		}
+		overrides[idx] = verdict
+	}
+
+	return &ListModerator{overrides: overrides}, nil
+}
+
+func (l *ListModerator) Classify(ctx context.Context, adIdx int, img image.Image) (Verdict, float64, error) {
+	return VerdictAllow, 0, nil
+}
+
+func (l *ListModerator) Override(adIdx int) (Verdict, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	verdict, ok := l.overrides[adIdx]
+	return verdict, ok
+}
+
+const defaultModerationTimeout = 15 * time.Second
+
+// HTTPModerator classifies ads by POSTing the decoded image to a
+// user-supplied URL as image/png and expecting a JSON response of the form
+// {"verdict": "allow"|"blur"|"block", "score": 0.0-1.0}, letting deployments
+// wire in any model server they like. It never overrides on its own.
+type HTTPModerator struct {
+	url        string
+	httpClient *http.Client
+}
+
+// NewHTTPModerator builds an HTTPModerator that POSTs to url.
+func NewHTTPModerator(url string) *HTTPModerator {
+	return &HTTPModerator{
+		url:        url,
+		httpClient: &http.Client{Timeout: defaultModerationTimeout},
+	}
+}
+
+func (h *HTTPModerator) Classify(ctx context.Context, adIdx int, img image.Image) (Verdict, float64, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return VerdictAllow, 0, fmt.Errorf("failed to encode ad %d for classification: %v", adIdx, err)
+	}
+
+	req, err := http.NewRequest("POST", h.url, &buf)
+	if err != nil {
+		return VerdictAllow, 0, err
+	}
+	req.Header.Set("Content-Type", "image/png")
+
+	resp, err := h.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return VerdictAllow, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return VerdictAllow, 0, fmt.Errorf("classifier %s: unexpected status %s", h.url, resp.Status)
+	}
+
+	var result struct {
+		Verdict Verdict `json:"verdict"`
+		Score   float64 `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return VerdictAllow, 0, fmt.Errorf("classifier %s: failed to decode response: %v", h.url, err)
+	}
+	if result.Verdict != VerdictAllow && result.Verdict != VerdictBlur && result.Verdict != VerdictBlock {
+		return VerdictAllow, 0, fmt.Errorf("classifier %s: invalid verdict %q", h.url, result.Verdict)
+	}
+
+	return result.Verdict, result.Score, nil
+}
+
+func (h *HTTPModerator) Override(adIdx int) (Verdict, bool) {
+	return "", false
+}
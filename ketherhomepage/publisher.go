@@ -0,0 +1,109 @@
+package ketherhomepage
+
+import (
+	"fmt"
+	"net/url"
+
+	"golang.org/x/net/context"
+)
+
+// Names used with Publisher.PutPNG to distinguish the 1x and 2x renders.
+const (
+	PNGName   = "png"
+	PNG2XName = "png2x"
+)
+
+// Publisher writes the generated JSON and PNG outputs somewhere operators
+// can serve them from. It deliberately knows nothing about GCS, S3, or any
+// other backend - NewKetherWatcher depends only on this interface so
+// deployments aren't tied to Google Cloud.
+type Publisher interface {
+	PutJSON(ctx context.Context, data []byte) error
+	PutPNG(ctx context.Context, name string, data []byte) error
+}
+
+// StateReader is implemented by Publishers that can read back their own
+// previously-written JSON, so a restart can recover the last-processed
+// block number instead of re-scanning the whole chain. Not every Publisher
+// needs to support this (e.g. a write-only mirror in a MultiPublisher).
+type StateReader interface {
+	GetJSON(ctx context.Context) ([]byte, error)
+}
+
+// NewPublisherFromURL builds a Publisher from a URL of the form
+// gs://bucket/prefix, s3://bucket/prefix, or file:///var/www/kether. The
+// prefix is used as a directory/key prefix under which ads.json, ads.png,
+// and ads@2x.png are written.
+func NewPublisherFromURL(ctx context.Context, rawURL string) (Publisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid publisher URL %q: %v", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "gs":
+		return NewGCSPublisher(ctx, u.Host, u.Path)
+	case "s3":
+		return NewS3Publisher(ctx, u.Host, u.Path)
+	case "file":
+		return NewFilePublisher(u.Path)
+	default:
+		return nil, fmt.Errorf("unsupported publisher scheme %q in %q", u.Scheme, rawURL)
+	}
+}
+
+// MultiPublisher fans writes out to several Publishers, e.g. to push to GCS
+// and mirror to local disk or IPFS in the same run. Each backend's errors
+// are isolated from the others: a failure writing to one backend doesn't
+// stop the others from being written, but is still reported to the caller.
+type MultiPublisher struct {
+	publishers []Publisher
+}
+
+func NewMultiPublisher(publishers ...Publisher) *MultiPublisher {
+	return &MultiPublisher{publishers: publishers}
+}
+
+func (m *MultiPublisher) PutJSON(ctx context.Context, data []byte) error {
+	var errs []error
+	for _, p := range m.publishers {
+		if err := p.PutJSON(ctx, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
+}
+
+func (m *MultiPublisher) PutPNG(ctx context.Context, name string, data []byte) error {
+	var errs []error
+	for _, p := range m.publishers {
+		if err := p.PutPNG(ctx, name, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return joinErrors(errs)
+}
+
+// GetJSON tries each publisher that implements StateReader in order and
+// returns the first successful read.
+func (m *MultiPublisher) GetJSON(ctx context.Context) ([]byte, error) {
+	for _, p := range m.publishers {
+		if r, ok := p.(StateReader); ok {
+			if data, err := r.GetJSON(ctx); err == nil {
+				return data, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no publisher in MultiPublisher could provide prior state")
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%d publisher write(s) failed:", len(errs))
+	for _, err := range errs {
+		msg += " " + err.Error() + ";"
+	}
+	return fmt.Errorf("%s", msg)
+}
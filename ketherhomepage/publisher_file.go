@@ -0,0 +1,75 @@
+package ketherhomepage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// FilePublisher writes the JSON/PNG outputs to a directory on local disk,
+// for self-hosted deployments (e.g. served directly by nginx) and for
+// tests that don't want to talk to any cloud provider.
+type FilePublisher struct {
+	dir     string
+	pngName map[string]string
+}
+
+// NewFilePublisher builds a FilePublisher rooted at dir, writing
+// dir/ads.json, dir/ads.png, and dir/ads@2x.png. dir is created if it
+// doesn't already exist.
+func NewFilePublisher(dir string) (*FilePublisher, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create publisher dir %q: %v", dir, err)
+	}
+
+	return &FilePublisher{
+		dir: dir,
+		pngName: map[string]string{
+			PNGName:   "ads.png",
+			PNG2XName: "ads@2x.png",
+		},
+	}, nil
+}
+
+func (f *FilePublisher) PutJSON(ctx context.Context, data []byte) error {
+	return f.writeFile("ads.json", data)
+}
+
+func (f *FilePublisher) PutPNG(ctx context.Context, name string, data []byte) error {
+	fileName, ok := f.pngName[name]
+	if !ok {
+		return errPublisherUnknownName(name)
+	}
+	return f.writeFile(fileName, data)
+}
+
+func (f *FilePublisher) GetJSON(ctx context.Context) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(f.dir, "ads.json"))
+}
+
+func (f *FilePublisher) writeFile(name string, data []byte) error {
+	// Write to a temp file and rename so concurrent readers (e.g. a web
+	// server serving dir directly) never see a partially-written file.
+	tmp, err := ioutil.TempFile(f.dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(f.dir, name))
+}
+
+func errPublisherUnknownName(name string) error {
+	return fmt.Errorf("publisher: unknown output name %q", name)
+}
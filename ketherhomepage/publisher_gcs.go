@@ -0,0 +1,100 @@
+package ketherhomepage
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"cloud.google.com/go/storage"
+)
+
+// GCSPublisher writes the JSON/PNG outputs to Google Cloud Storage, making
+// them public and setting a short cache lifetime so changes show up
+// promptly.
+type GCSPublisher struct {
+	jsonObject *storage.ObjectHandle
+	pngObjects map[string]*storage.ObjectHandle
+}
+
+// NewGCSPublisher builds a GCSPublisher under gs://bucketName/prefix,
+// writing prefix/ads.json, prefix/ads.png, and prefix/ads@2x.png.
+func NewGCSPublisher(ctx context.Context, bucketName string, prefix string) (*GCSPublisher, error) {
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewGCSPublisherWithPaths(storageClient, bucketName,
+		joinPrefix(prefix, "ads.json"),
+		joinPrefix(prefix, "ads.png"),
+		joinPrefix(prefix, "ads@2x.png"))
+}
+
+// NewGCSPublisherWithPaths builds a GCSPublisher from explicit object paths,
+// matching the original NewKetherWatcher(bucketName, jsonPath, pngPath,
+// png2XPath) signature for operators who don't want the ads.json/ads.png
+// naming convention.
+func NewGCSPublisherWithPaths(storageClient *storage.Client, bucketName, jsonPath, pngPath, png2XPath string) (*GCSPublisher, error) {
+	bucket := storageClient.Bucket(bucketName)
+	return &GCSPublisher{
+		jsonObject: bucket.Object(jsonPath),
+		pngObjects: map[string]*storage.ObjectHandle{
+			PNGName:   bucket.Object(pngPath),
+			PNG2XName: bucket.Object(png2XPath),
+		},
+	}, nil
+}
+
+func (g *GCSPublisher) PutJSON(ctx context.Context, data []byte) error {
+	return putGCSObject(ctx, g.jsonObject, data)
+}
+
+func (g *GCSPublisher) PutPNG(ctx context.Context, name string, data []byte) error {
+	obj, ok := g.pngObjects[name]
+	if !ok {
+		return errPublisherUnknownName(name)
+	}
+	return putGCSObject(ctx, obj, data)
+}
+
+func (g *GCSPublisher) GetJSON(ctx context.Context) ([]byte, error) {
+	r, err := g.jsonObject.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf := make([]byte, 0, 4096)
+	chunk := make([]byte, 4096)
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	return buf, nil
+}
+
+func putGCSObject(ctx context.Context, obj *storage.ObjectHandle, data []byte) error {
+	w := obj.NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if err := obj.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil {
+		return err
+	}
+	return obj.Update(ctx, storage.ObjectAttrsToUpdate{CacheControl: "public, max-age=600"})
+}
+
+func joinPrefix(prefix, name string) string {
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix == "" {
+		return name
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + name
+}
@@ -0,0 +1,82 @@
+package ketherhomepage
+
+import (
+	"bytes"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3Publisher writes the JSON/PNG outputs to an S3 bucket with public-read
+// ACLs, for operators who'd rather not depend on Google Cloud.
+type S3Publisher struct {
+	client  *s3.Client
+	bucket  string
+	jsonKey string
+	pngKeys map[string]string
+}
+
+// NewS3Publisher builds an S3Publisher under s3://bucket/prefix, writing
+// prefix/ads.json, prefix/ads.png, and prefix/ads@2x.png. Credentials and
+// region are resolved the standard AWS way (env vars, shared config, IAM
+// role).
+func NewS3Publisher(ctx context.Context, bucket string, prefix string) (*S3Publisher, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Publisher{
+		client:  s3.NewFromConfig(cfg),
+		bucket:  bucket,
+		jsonKey: joinPrefix(prefix, "ads.json"),
+		pngKeys: map[string]string{
+			PNGName:   joinPrefix(prefix, "ads.png"),
+			PNG2XName: joinPrefix(prefix, "ads@2x.png"),
+		},
+	}, nil
+}
+
+func (s *S3Publisher) PutJSON(ctx context.Context, data []byte) error {
+	return s.putObject(ctx, s.jsonKey, data, "application/json")
+}
+
+func (s *S3Publisher) PutPNG(ctx context.Context, name string, data []byte) error {
+	key, ok := s.pngKeys[name]
+	if !ok {
+		return errPublisherUnknownName(name)
+	}
+	return s.putObject(ctx, key, data, "image/png")
+}
+
+func (s *S3Publisher) GetJSON(ctx context.Context) ([]byte, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.jsonKey),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(out.Body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *S3Publisher) putObject(ctx context.Context, key string, data []byte, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		Body:         bytes.NewReader(data),
+		ContentType:  aws.String(contentType),
+		ACL:          "public-read",
+		CacheControl: aws.String("public, max-age=600"),
+	})
+	return err
+}
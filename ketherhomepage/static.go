@@ -2,7 +2,6 @@ package ketherhomepage
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"image"
@@ -11,9 +10,7 @@ import (
 	"image/png"
 	"log"
 	"math/big"
-	"net/http"
-	"net/url"
-	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
@@ -22,8 +19,6 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/nfnt/resize"
-
-	"cloud.google.com/go/storage"
 )
 
 var defaultBgColor = color.Transparent
@@ -45,6 +40,12 @@ type Ad struct {
 	Title     string `json:"title,omitempty"`
 	NSFW      bool   `json:"NSFW"`
 	ForceNSFW bool   `json:"forceNSFW"`
+
+	// Moderation and ModerationScore record the Moderator's verdict for this
+	// ad, so front-ends can offer a "click to reveal" affordance on Blur
+	// instead of just seeing a blurred image with no explanation.
+	Moderation      Verdict `json:"moderation,omitempty"`
+	ModerationScore float64 `json:"moderationScore,omitempty"`
 }
 
 type KetherData struct {
@@ -53,22 +54,46 @@ type KetherData struct {
 }
 
 type KetherWatcher struct {
-	name        string
-	ctx         context.Context
-	session     *KetherHomepageSession
-	jsonObject  *storage.ObjectHandle
-	pngObject   *storage.ObjectHandle
-	png2XObject *storage.ObjectHandle
-	rpcClient   *ethclient.Client
+	name      string
+	ctx       context.Context
+	session   *KetherHomepageSession
+	publisher Publisher
+	fetcher   *ImageFetcher
+	moderator Moderator
+	rpcClient ChainClient
+	indexer   *Indexer
 }
 
-func NewKetherWatcher(name string, rpcUrl string, contractAddr string, bucketName string, jsonPath string, pngPath string, png2XPath string) (*KetherWatcher, error) {
+// NewKetherWatcher builds a watcher for the KetherHomepage contract at
+// contractAddr, writing its outputs through publisher and fetching ad
+// images through fetcher. moderator decides how NSFW/unclassified ads are
+// rendered; pass nil to get a PassthroughModerator, which preserves the
+// behavior of only honoring the on-chain NSFW/ForceNSFW flags. fromBlock is
+// the block to start indexing from on a cold start; if publisher has
+// previously-written state (see StateReader) with a persisted blockNumber
+// later than fromBlock, indexing resumes from that block instead so
+// restarts don't re-scan the whole chain.
+func NewKetherWatcher(name string, rpcUrl string, contractAddr string, publisher Publisher, fetcher *ImageFetcher, moderator Moderator, fromBlock uint64) (*KetherWatcher, error) {
 	conn, err := ethclient.Dial(rpcUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	contract, err := NewKetherHomepage(common.HexToAddress(contractAddr), conn)
+	addr := common.HexToAddress(contractAddr)
+	return NewKetherWatcherWithClient(name, conn, conn, addr, publisher, fetcher, moderator, fromBlock)
+}
+
+// NewKetherWatcherWithClient builds a watcher from an already-connected
+// chainClient/contractBackend pair instead of dialing rpcUrl itself. It
+// exists so tests (see the ketherhomepage/testing subpackage) can point a
+// KetherWatcher at a backends.SimulatedBackend, which satisfies both
+// ChainClient and bind.ContractBackend, rather than a real node.
+func NewKetherWatcherWithClient(name string, chainClient ChainClient, contractBackend bind.ContractBackend, addr common.Address, publisher Publisher, fetcher *ImageFetcher, moderator Moderator, fromBlock uint64) (*KetherWatcher, error) {
+	if moderator == nil {
+		moderator = PassthroughModerator{}
+	}
+
+	contract, err := NewKetherHomepage(addr, contractBackend)
 	if err != nil {
 		return nil, err
 	}
@@ -87,127 +112,251 @@ func NewKetherWatcher(name string, rpcUrl string, contractAddr string, bucketNam
 	}
 
 	ctx := context.Background()
-	storageClient, err := storage.NewClient(ctx)
+
+	if persisted, ok := readPersistedBlockNumber(ctx, publisher); ok && persisted > fromBlock {
+		fromBlock = persisted
+	}
+
+	indexer, err := NewIndexer(name, chainClient, addr, fromBlock)
 	if err != nil {
 		return nil, err
 	}
 
-	bucket := storageClient.Bucket(bucketName)
-	jsonObject := bucket.Object(jsonPath)
-	pngObject := bucket.Object(pngPath)
-	png2XObject := bucket.Object(png2XPath)
-
 	kw := &KetherWatcher{
-		name:        name,
-		ctx:         ctx,
-		session:     session,
-		jsonObject:  jsonObject,
-		pngObject:   pngObject,
-		png2XObject: png2XObject,
-		rpcClient:   conn,
+		name:      name,
+		ctx:       ctx,
+		session:   session,
+		publisher: publisher,
+		fetcher:   fetcher,
+		moderator: moderator,
+		rpcClient: chainClient,
+		indexer:   indexer,
 	}
 	return kw, nil
 }
 
-func (w *KetherWatcher) Watch(duration time.Duration) {
-	tick := time.Tick(duration)
-	for range tick {
-		ctx := context.Background()
-		header, err := w.rpcClient.HeaderByNumber(ctx, nil)
-		if err != nil {
-			log.Printf("%s: Failed to call eth_blockNumber: %s", w.name, err)
-			continue
-		}
-
-		blockNumber := header.Number
+// readPersistedBlockNumber best-effort reads the blockNumber of a
+// previously-written KetherData object, so a restart can resume indexing
+// instead of re-scanning from fromBlock. ok is false if no prior state
+// could be read (e.g. first run, or publisher doesn't support StateReader).
+func readPersistedBlockNumber(ctx context.Context, publisher Publisher) (uint64, bool) {
+	reader, ok := publisher.(StateReader)
+	if !ok {
+		return 0, false
+	}
 
-		fmt.Println("block number", blockNumber)
+	raw, err := reader.GetJSON(ctx)
+	if err != nil {
+		return 0, false
+	}
 
-		log.Printf("%s: Syncing with blockchain, block %d", w.name, blockNumber)
+	var data KetherData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return 0, false
+	}
+	if data.BlockNumber <= 0 {
+		return 0, false
+	}
+	return uint64(data.BlockNumber), true
+}
 
-		adsImage := image.NewRGBA(image.Rect(0, 0, adsImageWidth, adsImageHeight))
-		adsImage2X := image.NewRGBA(image.Rect(0, 0, 2*adsImageWidth, 2*adsImageHeight))
-		draw.Draw(adsImage, adsImage.Bounds(), &image.Uniform{defaultBgColor}, image.ZP, draw.Src)
+// Watch indexes the contract incrementally: it does one FilterLogs sweep on
+// startup, then reacts to new events from a SubscribeFilterLogs
+// subscription. Regeneration of the PNG/JSON outputs is triggered by a
+// change signalled by the subscription, and on each maxInterval tick only
+// if the indexer still has unpublished changes, rather than by a bare
+// polling tick.
+func (w *KetherWatcher) Watch(maxInterval time.Duration) {
+	if err := w.SyncAndRegenerate(w.ctx); err != nil {
+		log.Printf("%s: initial sync failed: %v", w.name, err)
+	}
 
-		adsLength, err := w.session.GetAdsLength()
-		if err != nil {
-			log.Printf("%s: Failed to call getAdsLength: %v", w.name, err)
-			continue
+	changed := make(chan struct{}, 1)
+	go func() {
+		for {
+			// Subscribe does its own catch-up sync once the subscription is
+			// live, so there's no gap window to resync here before retrying -
+			// doing so would reintroduce the race Subscribe exists to avoid.
+			err := w.indexer.Subscribe(w.ctx, changed)
+			log.Printf("%s: log subscription ended, resubscribing: %v", w.name, err)
+			time.Sleep(5 * time.Second)
 		}
-		log.Printf("%s: Found %d ads", w.name, adsLength)
-
-		// We can't have more than MaxInt ads by defintion.
-		length := int(adsLength.Int64())
-		ads := make([]Ad, length)
-
-		for i := 0; i < length; i++ {
-			adData, err := w.session.Ads(big.NewInt(int64(i)))
-			if err != nil {
-				log.Printf("%s: Failed to retrieve the ad: %v", w.name, err)
-				continue
+	}()
+
+	ticker := time.NewTicker(maxInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-changed:
+			w.regenerate()
+		case <-ticker.C:
+			if w.indexer.Dirty() {
+				w.regenerate()
 			}
+		}
+	}
+}
 
-			ad := Ad{
-				Idx:       i,
-				Owner:     adData.Owner.Hex(),
-				X:         int(adData.X.Int64()),
-				Y:         int(adData.Y.Int64()),
-				Width:     int(adData.Width.Int64()),
-				Height:    int(adData.Height.Int64()),
-				Link:      adData.Link,
-				Image:     adData.Image,
-				Title:     adData.Title,
-				NSFW:      adData.NSFW,
-				ForceNSFW: adData.ForceNSFW,
-			}
-			ads[i] = ad
+// Dirty reports whether the indexer has changes that haven't yet been
+// published, e.g. because the last regenerate's publish failed.
+func (w *KetherWatcher) Dirty() bool {
+	return w.indexer.Dirty()
+}
 
-			err = drawAd(adsImage, adsImage2X, ad)
-			if err != nil {
-				// Don't fatal since we want to keep going
-				log.Printf("%s: error drawing ad %d: %v", w.name, i, err)
-				// we don't continue here
-			}
+// SyncAndRegenerate runs one FilterLogs sweep and, regardless of whether it
+// turned up any changes, redraws and publishes the outputs. It's the
+// one-shot equivalent of Watch's startup step, useful for tests that want
+// to drive the watcher without its long-lived subscribe loop.
+func (w *KetherWatcher) SyncAndRegenerate(ctx context.Context) error {
+	err := w.indexer.Sync(ctx)
+	w.regenerate()
+	return err
+}
 
-			log.Printf("%s: Drew ad %d. Link: %s, Image: %s, Title: %s", w.name, i, ad.Link, ad.Image, ad.Title)
+// regenerate redraws the PNG/JSON outputs from the indexer's current
+// snapshot and publishes them.
+func (w *KetherWatcher) regenerate() {
+	ads, blockNumber := w.indexer.Snapshot()
+	log.Printf("%s: Regenerating outputs at block %d, %d ads", w.name, blockNumber, len(ads))
+
+	adsImage := image.NewRGBA(image.Rect(0, 0, adsImageWidth, adsImageHeight))
+	adsImage2X := image.NewRGBA(image.Rect(0, 0, 2*adsImageWidth, 2*adsImageHeight))
+	draw.Draw(adsImage, adsImage.Bounds(), &image.Uniform{defaultBgColor}, image.ZP, draw.Src)
+
+	adImages := w.fetcher.FetchAll(w.ctx, ads)
+	verdicts := w.moderateAll(w.ctx, ads, adImages)
+	for i, ad := range ads {
+		verdict := verdicts[ad.Idx].verdict
+		ads[i].Moderation = verdict
+		ads[i].ModerationScore = verdicts[ad.Idx].score
+
+		if err := drawAd(adsImage, adsImage2X, ad, adImages[ad.Idx], verdict); err != nil {
+			// Don't fatal since we want to keep going
+			log.Printf("%s: error drawing ad %d: %v", w.name, i, err)
 		}
+	}
 
-		data := KetherData{BlockNumber: int(blockNumber.Int64()), Ads: ads}
-		json, err := json.Marshal(data)
-		if err != nil {
-			log.Printf("%s: Couldn't marshal ads to json: %v", w.name, err)
-			continue
-		}
+	data := KetherData{BlockNumber: int(blockNumber), Ads: ads}
+	jsonBytes, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("%s: Couldn't marshal ads to json: %v", w.name, err)
+		return
+	}
+
+	published := true
 
-		jsonW := w.jsonObject.NewWriter(w.ctx)
-		jsonW.Write(json)
-		jsonW.Close()
+	if err := w.publisher.PutJSON(w.ctx, jsonBytes); err != nil {
+		log.Printf("%s: Failed to publish JSON: %v", w.name, err)
+		published = false
+	} else {
 		log.Printf("%s: Wrote JSON", w.name)
+	}
 
-		pngW := w.pngObject.NewWriter(w.ctx)
-		png.Encode(pngW, adsImage)
-		pngW.Close()
+	var pngBuf, png2XBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, adsImage); err != nil {
+		log.Printf("%s: Failed to encode PNG: %v", w.name, err)
+		published = false
+	} else if err := w.publisher.PutPNG(w.ctx, PNGName, pngBuf.Bytes()); err != nil {
+		log.Printf("%s: Failed to publish PNG: %v", w.name, err)
+		published = false
+	} else {
 		log.Printf("%s: Wrote PNG", w.name)
+	}
 
-		png2XW := w.png2XObject.NewWriter(w.ctx)
-		png.Encode(png2XW, adsImage2X)
-		png2XW.Close()
+	if err := png.Encode(&png2XBuf, adsImage2X); err != nil {
+		log.Printf("%s: Failed to encode PNG @ 2x: %v", w.name, err)
+		published = false
+	} else if err := w.publisher.PutPNG(w.ctx, PNG2XName, png2XBuf.Bytes()); err != nil {
+		log.Printf("%s: Failed to publish PNG @ 2x: %v", w.name, err)
+		published = false
+	} else {
 		log.Printf("%s: Wrote PNG @ 2x", w.name)
+	}
+
+	// Only clear dirty once every output has actually landed - a partial
+	// failure (e.g. a transient storage blip) needs to stay dirty so
+	// Watch's maxInterval ticker retries instead of going permanently stale.
+	if published {
+		w.indexer.ClearDirty()
+	}
+}
+
+// moderationResult is a single ad's verdict and score, as returned by
+// moderateAll.
+type moderationResult struct {
+	verdict Verdict
+	score   float64
+}
+
+// moderateAll runs moderate over every ad concurrently, bounded by the same
+// worker count as the image fetcher. Classify can be a real network round
+// trip (see HTTPModerator), so moderating ads one at a time the way drawAd
+// composites them would reintroduce the serial-per-ad bottleneck FetchAll
+// already solved for image fetching one layer down.
+func (w *KetherWatcher) moderateAll(ctx context.Context, ads []Ad, adImages map[int]image.Image) map[int]moderationResult {
+	workers := w.fetcher.workers
+	if workers <= 0 {
+		workers = 8
+	}
 
-		// Set ACLs to public
-		w.jsonObject.ACL().Set(w.ctx, storage.AllUsers, storage.RoleReader)
-		w.pngObject.ACL().Set(w.ctx, storage.AllUsers, storage.RoleReader)
-		w.png2XObject.ACL().Set(w.ctx, storage.AllUsers, storage.RoleReader)
+	jobs := make(chan Ad)
+	results := make(map[int]moderationResult)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ad := range jobs {
+				reqCtx, cancel := context.WithTimeout(ctx, defaultModerationTimeout)
+				verdict, score := w.moderate(reqCtx, ad, adImages[ad.Idx])
+				cancel()
+
+				mu.Lock()
+				results[ad.Idx] = moderationResult{verdict: verdict, score: score}
+				mu.Unlock()
+			}
+		}()
+	}
 
-		// Lower the cache times
-		w.jsonObject.Update(w.ctx, storage.ObjectAttrsToUpdate{CacheControl: "public, max-age=600"})
-		w.pngObject.Update(w.ctx, storage.ObjectAttrsToUpdate{CacheControl: "public, max-age=600"})
-		w.png2XObject.Update(w.ctx, storage.ObjectAttrsToUpdate{CacheControl: "public, max-age=600"})
+	for _, ad := range ads {
+		jobs <- ad
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// moderate decides the verdict for ad, preferring (in order) a static
+// Override, the on-chain NSFW/ForceNSFW flags (preserving the
+// pre-Moderator behavior of always blocking those), and finally the
+// Moderator's own classification of adImage, if one was fetched.
+func (w *KetherWatcher) moderate(ctx context.Context, ad Ad, adImage image.Image) (Verdict, float64) {
+	if verdict, ok := w.moderator.Override(ad.Idx); ok {
+		return verdict, 0
+	}
+	if ad.NSFW || ad.ForceNSFW {
+		return VerdictBlock, 0
+	}
+	if adImage == nil {
+		return VerdictAllow, 0
+	}
 
+	verdict, score, err := w.moderator.Classify(ctx, ad.Idx, adImage)
+	if err != nil {
+		log.Printf("%s: moderation of ad %d failed, allowing: %v", w.name, ad.Idx, err)
+		return VerdictAllow, 0
 	}
+	return verdict, score
 }
 
-func drawAd(img *image.RGBA, img2X *image.RGBA, ad Ad) error {
+// drawAd renders a single ad into the composed canvases according to
+// verdict. adImage is the already-fetched, already-decoded ad image (nil if
+// the ad has no image or its fetch failed), so drawAd itself does no
+// network I/O - see ImageFetcher for that.
+func drawAd(img *image.RGBA, img2X *image.RGBA, ad Ad, adImage image.Image, verdict Verdict) error {
 	cellWidth := 10
 	x := ad.X * cellWidth
 	y := ad.Y * cellWidth
@@ -221,17 +370,24 @@ func drawAd(img *image.RGBA, img2X *image.RGBA, ad Ad) error {
 		draw.Draw(img, adBounds, &image.Uniform{defaultEmptyColor}, image.ZP, draw.Over)
 		draw.Draw(img2X, adBounds2X, &image.Uniform{defaultEmptyColor}, image.ZP, draw.Over)
 		return nil
-	} else if ad.NSFW || ad.ForceNSFW {
+	} else if verdict == VerdictBlock {
 		draw.Draw(img, adBounds, &image.Uniform{defaultNSFWColor}, image.ZP, draw.Over)
 		draw.Draw(img2X, adBounds2X, &image.Uniform{defaultNSFWColor}, image.ZP, draw.Over)
 		return nil
 	}
 
-	adImage, err := getImage(ad.Image)
-	if err != nil {
+	if adImage == nil {
 		draw.Draw(img, adBounds, &image.Uniform{defaultEmptyColor}, image.ZP, draw.Over)
 		draw.Draw(img2X, adBounds2X, &image.Uniform{defaultEmptyColor}, image.ZP, draw.Over)
-		return err
+		return fmt.Errorf("no image available for %s", ad.Image)
+	}
+
+	if verdict == VerdictBlur {
+		blurredAdImg := blurAdImage(adImage, width, height)
+		blurredAdImg2X := blurAdImage(adImage, width*2, height*2)
+		draw.Draw(img, adBounds, blurredAdImg, image.ZP, draw.Over)
+		draw.Draw(img2X, adBounds2X, blurredAdImg2X, image.ZP, draw.Over)
+		return nil
 	}
 
 	scaledAdImg := resize.Resize(uint(width), uint(height), adImage, resize.Bicubic)
@@ -242,47 +398,23 @@ func drawAd(img *image.RGBA, img2X *image.RGBA, ad Ad) error {
 	return nil
 }
 
-func getImage(imageUrl string) (image.Image, error) {
-	u, err := url.Parse(imageUrl)
-	if err != nil {
-		return nil, err
+// blurDownscaleFactor controls how aggressively blurAdImage downsamples
+// before scaling back up; higher values produce a blurrier result.
+const blurDownscaleFactor = 8
+
+// blurAdImage renders a box-blurred version of adImage at width x height by
+// downsampling to a fraction of that size and back up, which averages away
+// fine detail without pulling in a dedicated blur library.
+func blurAdImage(adImage image.Image, width, height int) image.Image {
+	smallWidth := width / blurDownscaleFactor
+	if smallWidth < 1 {
+		smallWidth = 1
 	}
-	if u.Scheme == "http" || u.Scheme == "https" {
-		resp, err := http.Get(imageUrl)
-		if err != nil {
-			return nil, err
-		}
-
-		adImage, _, err := image.Decode(resp.Body)
-		return adImage, err
-
-	} else if u.Scheme == "data" {
-		// This is not a fully compliant way of parsing data:// urls, assumes
-		// they are base64 encoded. Should work for now though
-		imgData, err := base64.StdEncoding.DecodeString(strings.Split(u.Opaque, ",")[1])
-		if err != nil {
-			return nil, err
-		}
-
-		adImage, _, err := image.Decode(bytes.NewReader(imgData))
-		return adImage, err
-	} else if u.Scheme == "ipfs" {
-		resp, err := http.Get("https://gateway.ipfs.io/ipfs/" + u.Host)
-		if err != nil {
-			return nil, err
-		}
-
-		adImage, _, err := image.Decode(resp.Body)
-		return adImage, err
-	} else if u.Scheme == "bzz" {
-		resp, err := http.Get("http://swarm-gateways.net/bzz:/" + u.Host)
-		if err != nil {
-			return nil, err
-		}
-
-		adImage, _, err := image.Decode(resp.Body)
-		return adImage, err
-	} else {
-		return nil, fmt.Errorf("Couldn't parse image URL: %s", imageUrl)
+	smallHeight := height / blurDownscaleFactor
+	if smallHeight < 1 {
+		smallHeight = 1
 	}
+
+	small := resize.Resize(uint(smallWidth), uint(smallHeight), adImage, resize.Bilinear)
+	return resize.Resize(uint(width), uint(height), small, resize.Bilinear)
 }
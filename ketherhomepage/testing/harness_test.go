@@ -0,0 +1,295 @@
+package kettertesting_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/bradparks/ketherstatic/ketherhomepage"
+	kettertesting "github.com/bradparks/ketherstatic/ketherhomepage/testing"
+)
+
+// cellWidth mirrors the cell width drawAd uses internally to convert grid
+// coordinates to pixels.
+const cellWidth = 10
+
+// solidColorDataURI encodes a 1x1 PNG of c as a data: URI, so the fetcher
+// can resolve it without any network access.
+func solidColorDataURI(t *testing.T, c color.Color) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, c)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func newFetcher(t *testing.T) *ketherhomepage.ImageFetcher {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ketherhomepage-test-cache")
+	if err != nil {
+		t.Fatalf("failed to create cache dir: %v", err)
+	}
+	fetcher, err := ketherhomepage.NewImageFetcher(dir, 0, nil, 4)
+	if err != nil {
+		t.Fatalf("NewImageFetcher: %v", err)
+	}
+	return fetcher
+}
+
+func TestEndToEndAdsJSONAndPNG(t *testing.T) {
+	h, err := kettertesting.NewHarness("e2e", newFetcher(t), nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %v", err)
+	}
+
+	red := solidColorDataURI(t, color.RGBA{R: 255, A: 255})
+	if err := h.PublishAd(0, 0, 0, 10, 10, "https://example.com", red, "red ad", false); err != nil {
+		t.Fatalf("publish red ad: %v", err)
+	}
+	if err := h.PublishAd(1, 10, 0, 10, 10, "https://example.com", "", "empty ad", false); err != nil {
+		t.Fatalf("publish empty ad: %v", err)
+	}
+	blue := solidColorDataURI(t, color.RGBA{B: 255, A: 255})
+	if err := h.PublishAd(2, 20, 0, 10, 10, "https://example.com", blue, "soon nsfw ad", false); err != nil {
+		t.Fatalf("publish nsfw ad: %v", err)
+	}
+	if err := h.ForceNSFW(2, true); err != nil {
+		t.Fatalf("force nsfw: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := h.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	var data ketherhomepage.KetherData
+	if err := json.Unmarshal(h.Publisher.JSON(), &data); err != nil {
+		t.Fatalf("unmarshal published JSON: %v", err)
+	}
+	if len(data.Ads) != 3 {
+		t.Fatalf("got %d ads, want 3: %+v", len(data.Ads), data.Ads)
+	}
+	if data.Ads[0].Title != "red ad" || data.Ads[0].NSFW {
+		t.Errorf("ad 0 = %+v, want title %q, NSFW false", data.Ads[0], "red ad")
+	}
+	if data.Ads[1].Image != "" {
+		t.Errorf("ad 1 Image = %q, want empty", data.Ads[1].Image)
+	}
+	if !data.Ads[2].ForceNSFW {
+		t.Errorf("ad 2 ForceNSFW = false, want true")
+	}
+
+	png1x, err := png.Decode(bytes.NewReader(h.Publisher.PNG(ketherhomepage.PNGName)))
+	if err != nil {
+		t.Fatalf("decode published PNG: %v", err)
+	}
+
+	cases := []struct {
+		name            string
+		x, y            int
+		want            color.Color
+		wantTransparent bool
+	}{
+		{name: "solid color ad", x: 5, y: 5, want: color.RGBA{R: 255, A: 255}},
+		{name: "empty ad", x: 15, y: 5, wantTransparent: true},
+		{name: "force-NSFW ad", x: 25, y: 5, want: color.RGBA{A: 255}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			px := png1x.At(c.x*cellWidth+cellWidth/2, c.y*cellWidth+cellWidth/2)
+			r, g, b, a := px.RGBA()
+			if c.wantTransparent {
+				if a != 0 {
+					t.Errorf("pixel at (%d,%d) = (%d,%d,%d,%d), want fully transparent", c.x, c.y, r, g, b, a)
+				}
+				return
+			}
+			wr, wg, wb, wa := c.want.RGBA()
+			if r != wr || g != wg || b != wb || a != wa {
+				t.Errorf("pixel at (%d,%d) = (%d,%d,%d,%d), want (%d,%d,%d,%d)", c.x, c.y, r, g, b, a, wr, wg, wb, wa)
+			}
+		})
+	}
+}
+
+// TestIndexerConvergesAfterRandomMutations asserts that an indexer which
+// re-syncs after every mutation ends up in the same state as an indexer
+// that only does a single full rescan at the end, for the same sequence of
+// on-chain events.
+func TestIndexerConvergesAfterRandomMutations(t *testing.T) {
+	h, err := kettertesting.NewHarness("convergence", newFetcher(t), nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %v", err)
+	}
+
+	const numAds = 5
+	for i := 0; i < numAds; i++ {
+		if err := h.PublishAd(i, i*cellWidth, 0, 1, 1, "", "", "ad", false); err != nil {
+			t.Fatalf("publish ad %d: %v", i, err)
+		}
+	}
+
+	ctx := context.Background()
+	incremental, err := ketherhomepage.NewIndexer("incremental", h.Backend, h.Addr, 0)
+	if err != nil {
+		t.Fatalf("NewIndexer(incremental): %v", err)
+	}
+	if err := incremental.Sync(ctx); err != nil {
+		t.Fatalf("incremental initial sync: %v", err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	owners := make([]*bind.TransactOpts, 3)
+	for i := range owners {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		owners[i] = bind.NewKeyedTransactor(key)
+	}
+
+	for step := 0; step < 30; step++ {
+		idx := rng.Intn(numAds)
+		switch rng.Intn(2) {
+		case 0:
+			if err := h.ForceNSFW(idx, rng.Intn(2) == 0); err != nil {
+				t.Fatalf("step %d: ForceNSFW: %v", step, err)
+			}
+		case 1:
+			if err := h.SetAdOwner(idx, owners[rng.Intn(len(owners))].From); err != nil {
+				t.Fatalf("step %d: SetAdOwner: %v", step, err)
+			}
+		}
+		if err := incremental.Sync(ctx); err != nil {
+			t.Fatalf("step %d: incremental sync: %v", step, err)
+		}
+	}
+
+	full, err := ketherhomepage.NewIndexer("full", h.Backend, h.Addr, 0)
+	if err != nil {
+		t.Fatalf("NewIndexer(full): %v", err)
+	}
+	if err := full.Sync(ctx); err != nil {
+		t.Fatalf("full rescan: %v", err)
+	}
+
+	incAds, incBlock := incremental.Snapshot()
+	fullAds, fullBlock := full.Snapshot()
+	if incBlock != fullBlock {
+		t.Fatalf("incremental converged to block %d, full rescan to block %d", incBlock, fullBlock)
+	}
+	if !reflect.DeepEqual(incAds, fullAds) {
+		t.Fatalf("incremental indexer diverged from full rescan:\nincremental: %+v\nfull:        %+v", incAds, fullAds)
+	}
+}
+
+// TestRegenerateRetriesAfterPublishFailure asserts that a failed publish
+// leaves the watcher dirty so a later regenerate (standing in for Watch's
+// maxInterval ticker) retries and recovers, rather than the indexer having
+// already cleared its dirty flag before publishing actually succeeded.
+func TestRegenerateRetriesAfterPublishFailure(t *testing.T) {
+	h, err := kettertesting.NewHarness("retry", newFetcher(t), nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %v", err)
+	}
+
+	if err := h.PublishAd(0, 0, 0, 10, 10, "", "", "ad", false); err != nil {
+		t.Fatalf("publish ad: %v", err)
+	}
+
+	h.Publisher.FailNextJSON(fmt.Errorf("simulated transient publish failure"))
+
+	ctx := context.Background()
+	if err := h.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if len(h.Publisher.JSON()) != 0 {
+		t.Fatalf("JSON published despite simulated PutJSON failure")
+	}
+	if !h.Watcher.Dirty() {
+		t.Fatalf("watcher not dirty after a failed publish, want dirty so the next tick retries")
+	}
+
+	if err := h.Sync(ctx); err != nil {
+		t.Fatalf("retry Sync: %v", err)
+	}
+	if len(h.Publisher.JSON()) == 0 {
+		t.Fatalf("JSON still unpublished after retry")
+	}
+	if h.Watcher.Dirty() {
+		t.Fatalf("watcher still dirty after a successful publish")
+	}
+}
+
+// TestListModeratorOverridesBlurAd asserts that a ListModerator override
+// takes effect even for an ad with no on-chain NSFW flags, that the verdict
+// is recorded in the published JSON, and that the rendered pixels are
+// neither the solid NSFW block color nor fully transparent.
+func TestListModeratorOverridesBlurAd(t *testing.T) {
+	listDir, err := ioutil.TempDir("", "ketherhomepage-test-modlist")
+	if err != nil {
+		t.Fatalf("failed to create moderation list dir: %v", err)
+	}
+	listPath := filepath.Join(listDir, "moderation.yaml")
+	if err := ioutil.WriteFile(listPath, []byte(`"0": blur`+"\n"), 0644); err != nil {
+		t.Fatalf("write moderation list: %v", err)
+	}
+	moderator, err := ketherhomepage.NewListModerator(listPath)
+	if err != nil {
+		t.Fatalf("NewListModerator: %v", err)
+	}
+
+	h, err := kettertesting.NewHarness("moderation", newFetcher(t), moderator)
+	if err != nil {
+		t.Fatalf("NewHarness: %v", err)
+	}
+
+	green := solidColorDataURI(t, color.RGBA{G: 255, A: 255})
+	if err := h.PublishAd(0, 0, 0, 10, 10, "", green, "blurred ad", false); err != nil {
+		t.Fatalf("publish ad: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := h.Sync(ctx); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	var data ketherhomepage.KetherData
+	if err := json.Unmarshal(h.Publisher.JSON(), &data); err != nil {
+		t.Fatalf("unmarshal published JSON: %v", err)
+	}
+	if len(data.Ads) != 1 || data.Ads[0].Moderation != ketherhomepage.VerdictBlur {
+		t.Fatalf("got ads %+v, want a single ad with moderation %q", data.Ads, ketherhomepage.VerdictBlur)
+	}
+
+	png1x, err := png.Decode(bytes.NewReader(h.Publisher.PNG(ketherhomepage.PNGName)))
+	if err != nil {
+		t.Fatalf("decode published PNG: %v", err)
+	}
+	px := png1x.At(5*cellWidth+cellWidth/2, 5*cellWidth+cellWidth/2)
+	r, g, b, a := px.RGBA()
+	if a == 0 {
+		t.Fatalf("blurred ad pixel is fully transparent, want some rendered content")
+	}
+	if r == 0 && g == 0 && b == 0 {
+		t.Fatalf("blurred ad pixel is solid black, want the blurred image rather than the NSFW block color")
+	}
+}
@@ -0,0 +1,78 @@
+package kettertesting
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/bradparks/ketherstatic/ketherhomepage"
+)
+
+// FakePublisher is an in-memory ketherhomepage.Publisher (and StateReader)
+// for tests: PutJSON/PutPNG just keep the latest bytes in memory instead of
+// writing to any real backend.
+type FakePublisher struct {
+	mu           sync.Mutex
+	json         []byte
+	pngs         map[string][]byte
+	failNextJSON error
+}
+
+// NewFakePublisher builds an empty FakePublisher.
+func NewFakePublisher() *FakePublisher {
+	return &FakePublisher{pngs: make(map[string][]byte)}
+}
+
+// FailNextJSON makes the next PutJSON call return err instead of succeeding,
+// so tests can exercise a watcher's recovery from a transient publish
+// failure. Subsequent calls succeed normally.
+func (f *FakePublisher) FailNextJSON(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failNextJSON = err
+}
+
+func (f *FakePublisher) PutJSON(ctx context.Context, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failNextJSON != nil {
+		err := f.failNextJSON
+		f.failNextJSON = nil
+		return err
+	}
+	f.json = append([]byte(nil), data...)
+	return nil
+}
+
+func (f *FakePublisher) PutPNG(ctx context.Context, name string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pngs[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// GetJSON implements ketherhomepage.StateReader, returning the last bytes
+// written by PutJSON.
+func (f *FakePublisher) GetJSON(ctx context.Context) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.json, nil
+}
+
+// JSON returns the last bytes written by PutJSON, for assertions.
+func (f *FakePublisher) JSON() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.json
+}
+
+// PNG returns the last bytes written by PutPNG under name (ketherhomepage.PNGName
+// or ketherhomepage.PNG2XName), for assertions.
+func (f *FakePublisher) PNG(name string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pngs[name]
+}
+
+var _ ketherhomepage.Publisher = (*FakePublisher)(nil)
+var _ ketherhomepage.StateReader = (*FakePublisher)(nil)